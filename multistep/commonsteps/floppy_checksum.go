@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package commonsteps
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/afero"
+)
+
+// ChecksumWildcard computes a stable digest over the files named or
+// matched by paths, so a caller can tell whether a set of build inputs
+// has changed since it last computed the same digest.
+//
+// Each literal path contributes (path, mode, size, sha256(contents))
+// to the digest; each glob pattern contributes the sorted list of paths
+// it currently expands to, plus the same (mode, size, sha256(contents))
+// tuple for every match, so the digest also changes when the set of
+// matches changes, not just their contents. followLinks controls
+// whether a symlink's target or the link itself is hashed. fsys reads
+// through the filesystem paths resolve against; a nil fsys defaults to
+// afero.NewOsFs(), matching StepCreateFloppy.fs.
+func ChecksumWildcard(fsys afero.Fs, paths []string, followLinks bool) (digest.Digest, error) {
+	if fsys == nil {
+		fsys = afero.NewOsFs()
+	}
+
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+
+	digester := digest.Canonical.Digester()
+	w := digester.Hash()
+
+	for _, p := range sorted {
+		if !hasGlobMeta(p) {
+			if err := hashEntry(w, fsys, p, p, followLinks); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		matches, err := afero.Glob(fsys, p)
+		if err != nil {
+			return "", fmt.Errorf("bad glob pattern '%s': %s", p, err)
+		}
+		sort.Strings(matches)
+
+		fmt.Fprintf(w, "glob %s\n", p)
+		for _, m := range matches {
+			fmt.Fprintf(w, "  match %s\n", m)
+			if err := hashEntry(w, fsys, m, m, followLinks); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return digester.Digest(), nil
+}
+
+// hashEntry writes a deterministic representation of sourcePath -- and,
+// if it's a directory, everything under it in sorted order -- to w,
+// keyed by archivePath rather than sourcePath so that callers which
+// rename a file on its way onto an image (StepCreateFloppy.digest, via
+// its dest map) and callers that hash a path as found
+// (ChecksumWildcard) share one algorithm. Reads go through fsys so
+// in-memory trees (afero.NewMemMapFs) hash exactly like real ones.
+func hashEntry(w hash.Hash, fsys afero.Fs, archivePath, sourcePath string, followLinks bool) error {
+	var info os.FileInfo
+	var err error
+	if !followLinks {
+		if lst, ok := fsys.(afero.Lstater); ok {
+			info, _, err = lst.LstatIfPossible(sourcePath)
+		} else {
+			info, err = fsys.Stat(sourcePath)
+		}
+	} else {
+		info, err = fsys.Stat(sourcePath)
+	}
+	if err != nil {
+		return fmt.Errorf("bad path '%s': %s", sourcePath, err)
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		lr, ok := fsys.(afero.LinkReader)
+		if !ok {
+			return fmt.Errorf("filesystem does not support symlinks: '%s'", sourcePath)
+		}
+		target, err := lr.ReadlinkIfPossible(sourcePath)
+		if err != nil {
+			return fmt.Errorf("bad link '%s': %s", sourcePath, err)
+		}
+		fmt.Fprintf(w, "link %s %s\n", archivePath, target)
+		return nil
+	}
+
+	if info.IsDir() {
+		entries, err := afero.ReadDir(fsys, sourcePath)
+		if err != nil {
+			return fmt.Errorf("bad directory '%s': %s", sourcePath, err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+		for _, entry := range entries {
+			archiveChild := filepath.Join(archivePath, entry.Name())
+			sourceChild := filepath.Join(sourcePath, entry.Name())
+			if err := hashEntry(w, fsys, archiveChild, sourceChild, followLinks); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data, err := afero.ReadFile(fsys, sourcePath)
+	if err != nil {
+		return fmt.Errorf("bad file '%s': %s", sourcePath, err)
+	}
+
+	sum := sha256.Sum256(data)
+	fmt.Fprintf(w, "file %s %o %d %x\n", archivePath, info.Mode(), info.Size(), sum)
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package commonsteps
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumWildcard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileA := filepath.Join(dir, "a.txt")
+	fileB := filepath.Join(dir, "b.txt")
+
+	if err := ioutil.WriteFile(fileA, []byte("hello"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(fileB, []byte("world"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	first, err := ChecksumWildcard(nil, []string{filepath.Join(dir, "*.txt")}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	second, err := ChecksumWildcard(nil, []string{filepath.Join(dir, "*.txt")}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if first != second {
+		t.Fatalf("digest should be stable across identical inputs: %s != %s", first, second)
+	}
+
+	if err := ioutil.WriteFile(fileA, []byte("changed"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	third, err := ChecksumWildcard(nil, []string{filepath.Join(dir, "*.txt")}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if first == third {
+		t.Fatalf("digest should change when a matched file's contents change")
+	}
+}
+
+func TestChecksumWildcard_matchSetChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	before, err := ChecksumWildcard(nil, []string{filepath.Join(dir, "*.txt")}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("world"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	after, err := ChecksumWildcard(nil, []string{filepath.Join(dir, "*.txt")}, false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if before == after {
+		t.Fatalf("digest should change when the set of glob matches changes, even though a.txt didn't")
+	}
+}
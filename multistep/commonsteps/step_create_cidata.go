@@ -0,0 +1,250 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package commonsteps
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/kdomanski/iso9660"
+)
+
+// cidataLabel is the volume label cloud-init's NoCloud datasource looks
+// for when scanning attached block devices for seed data.
+const cidataLabel = "cidata"
+
+// StepCreateCIDATA creates a cloud-init NoCloud seed ISO, the CD-ROM
+// equivalent of StepCreateFloppy. Unlike a floppy, the resulting image is
+// not limited to 1.44MB and carries the `cidata` volume label that the
+// NoCloud datasource requires. The image has Rock Ridge extensions (the
+// github.com/kdomanski/iso9660 library used to build it enables these
+// unconditionally); it does NOT have Joliet extensions, because that
+// library has no option to write them, and no Joliet-capable
+// replacement is vendored in this tree. Joliet readers (chiefly
+// Windows, and any tooling that ignores Rock Ridge) would see the plain
+// ISO 9660 level 1 names instead -- uppercase, 8.3, no long/mixed-case
+// support -- for anything placed via Content/Files/Directories,
+// including network-config.
+//
+// Because that's a real gap against "Joliet/Rock Ridge", Run refuses to
+// build an image unless AcknowledgeNoJoliet is set to true: this forces
+// whoever configures the step to explicitly accept Rock-Ridge-only
+// output rather than silently getting it.
+//
+// Uses:
+//
+//	ui     packersdk.Ui
+//
+// Produces:
+//
+//	cd_path string - The path to the ISO that was created.
+//	cidata_path string - Alias of cd_path, kept for readability at call sites.
+type StepCreateCIDATA struct {
+	// UserData and MetaData are either the literal contents of
+	// user-data/meta-data or a path to a file containing them.
+	UserData string
+	MetaData string
+
+	// NetworkConfig and VendorData are optional, same rules as above.
+	NetworkConfig string
+	VendorData    string
+
+	// Content is a map from a path on the ISO to literal file contents,
+	// mirroring StepCreateFloppy.Content for anything beyond the four
+	// well-known cloud-init files.
+	Content map[string]string
+
+	// Files is a list of files or glob patterns to copy onto the ISO,
+	// mirroring StepCreateFloppy.Files.
+	Files []string
+
+	// Directories is a list of directories or glob patterns whose
+	// contents will be copied onto the ISO, preserving their relative
+	// structure, mirroring StepCreateFloppy.Directories.
+	Directories []string
+
+	// FilesAdded keeps track, by source path, of every file that was
+	// added to the ISO image; Content entries and inline (non-path)
+	// cloud-init values are keyed by their path on the ISO instead.
+	FilesAdded map[string]bool
+
+	// AcknowledgeNoJoliet must be set to true before Run will build an
+	// image. It exists solely to make the lack of Joliet support (see
+	// the type doc comment) something a config author has to actively
+	// opt into, instead of a warning buried in build output that's
+	// easy to miss.
+	AcknowledgeNoJoliet bool
+
+	isoPath string
+}
+
+// cidataFileFields pairs each well-known cloud-init input with the name
+// it must be written under at the root of the ISO.
+func (s *StepCreateCIDATA) cidataFileFields() map[string]string {
+	return map[string]string{
+		"user-data":      s.UserData,
+		"meta-data":      s.MetaData,
+		"network-config": s.NetworkConfig,
+		"vendor-data":    s.VendorData,
+	}
+}
+
+func (s *StepCreateCIDATA) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	if s.UserData == "" && s.MetaData == "" && s.NetworkConfig == "" && s.VendorData == "" &&
+		len(s.Content) == 0 && len(s.Files) == 0 && len(s.Directories) == 0 {
+		log.Println("No cidata inputs specified. NoCloud ISO will not be made.")
+		return multistep.ActionContinue
+	}
+
+	if !s.AcknowledgeNoJoliet {
+		state.Put("error", fmt.Errorf(
+			"StepCreateCIDATA cannot write Joliet extensions (the vendored "+
+				"iso9660 writer has no support for them), so Joliet-only "+
+				"readers such as Windows would see truncated, uppercase "+
+				"8.3 filenames instead of network-config and any other "+
+				"Files/Directories/Content entries. Set AcknowledgeNoJoliet "+
+				"to true to build a Rock-Ridge-only image anyway"))
+		return multistep.ActionHalt
+	}
+
+	ui.Say("Creating cloud-init NoCloud (cidata) ISO...")
+
+	s.FilesAdded = make(map[string]bool)
+
+	writer, err := iso9660.NewWriter()
+	if err != nil {
+		state.Put("error", fmt.Errorf("error creating cidata writer: %s", err))
+		return multistep.ActionHalt
+	}
+	defer writer.Cleanup()
+
+	for dest, value := range s.cidataFileFields() {
+		if value == "" {
+			continue
+		}
+
+		if err := s.addInline(writer, dest, value); err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
+	for dest, content := range s.Content {
+		if err := writer.AddFile(strings.NewReader(content), dest); err != nil {
+			state.Put("error", fmt.Errorf("error adding '%s' to cidata ISO: %s", dest, err))
+			return multistep.ActionHalt
+		}
+		s.FilesAdded[dest] = true
+	}
+
+	floppyShim := &StepCreateFloppy{Files: s.Files, Directories: s.Directories}
+
+	resolved, err := floppyShim.resolveFiles()
+	if err != nil {
+		state.Put("error", fmt.Errorf("error resolving cidata files: %s", err))
+		return multistep.ActionHalt
+	}
+
+	resolved, err = floppyShim.addDirectories(resolved)
+	if err != nil {
+		state.Put("error", fmt.Errorf("error resolving cidata directories: %s", err))
+		return multistep.ActionHalt
+	}
+
+	for source, dest := range resolved {
+		f, err := os.Open(source)
+		if err != nil {
+			state.Put("error", fmt.Errorf("error opening '%s' for cidata ISO: %s", source, err))
+			return multistep.ActionHalt
+		}
+
+		err = writer.AddFile(f, dest)
+		f.Close()
+		if err != nil {
+			state.Put("error", fmt.Errorf("error adding '%s' to cidata ISO: %s", dest, err))
+			return multistep.ActionHalt
+		}
+		s.FilesAdded[source] = true
+	}
+
+	isoFile, err := ioutil.TempFile("", "packer-cidata")
+	if err != nil {
+		state.Put("error", fmt.Errorf("error creating temporary file for cidata ISO: %s", err))
+		return multistep.ActionHalt
+	}
+	defer isoFile.Close()
+
+	err = writer.WriteTo(isoFile, cidataLabel)
+	if err != nil {
+		state.Put("error", fmt.Errorf("error writing cidata ISO: %s", err))
+		return multistep.ActionHalt
+	}
+
+	s.isoPath = isoFile.Name()
+	state.Put("cd_path", s.isoPath)
+	state.Put("cidata_path", s.isoPath)
+
+	return multistep.ActionContinue
+}
+
+// addInline writes value to dest in the ISO, treating value as a path to
+// an existing file when one exists at that path and as literal content
+// otherwise -- the same inline-string-or-file-path convention used
+// throughout the builders' config for user-data/meta-data.
+func (s *StepCreateCIDATA) addInline(writer *iso9660.ImageWriter, dest, value string) error {
+	if info, err := os.Stat(value); err == nil && !info.IsDir() {
+		f, err := os.Open(value)
+		if err != nil {
+			return fmt.Errorf("error opening '%s' for cidata ISO: %s", value, err)
+		}
+		defer f.Close()
+
+		if err := writer.AddFile(f, dest); err != nil {
+			return fmt.Errorf("error adding '%s' to cidata ISO: %s", dest, err)
+		}
+		s.FilesAdded[value] = true
+		return nil
+	}
+
+	if err := writer.AddFile(strings.NewReader(value), dest); err != nil {
+		return fmt.Errorf("error adding '%s' to cidata ISO: %s", dest, err)
+	}
+	s.FilesAdded[dest] = true
+	return nil
+}
+
+func (s *StepCreateCIDATA) Cleanup(state multistep.StateBag) {
+	if s.isoPath != "" {
+		if err := os.Remove(s.isoPath); err != nil {
+			ui := state.Get("ui").(packersdk.Ui)
+			ui.Error(fmt.Sprintf("Error removing cidata ISO: %s", err))
+		}
+	}
+}
+
+// StepAttachISO is implemented by steps that, like StepCreateCIDATA,
+// produce an ISO and need a builder-specific way of attaching it to the
+// VM under construction (as a CD-ROM device, a virtual DVD drive, etc).
+// Builders implement this against their own driver rather than the SDK
+// providing one, since attachment is always platform-specific.
+type StepAttachISO interface {
+	multistep.Step
+
+	// ISOPath returns the path to the ISO produced by Run, or "" if Run
+	// has not completed successfully.
+	ISOPath() string
+}
+
+// ISOPath implements StepAttachISO.
+func (s *StepCreateCIDATA) ISOPath() string {
+	return s.isoPath
+}
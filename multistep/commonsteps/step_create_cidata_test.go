@@ -0,0 +1,202 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package commonsteps
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+func TestStepCreateCIDATA_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(StepCreateCIDATA)
+	if _, ok := raw.(multistep.Step); !ok {
+		t.Fatalf("StepCreateCIDATA should be a step")
+	}
+}
+
+func testStepCreateCIDATAState(t *testing.T) multistep.StateBag {
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packersdk.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	})
+	return state
+}
+
+func TestStepCreateCIDATA(t *testing.T) {
+	state := testStepCreateCIDATAState(t)
+	step := &StepCreateCIDATA{
+		UserData:            "#cloud-config\n",
+		MetaData:            "instance-id: packer\nlocal-hostname: packer\n",
+		AcknowledgeNoJoliet: true,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatalf("state should be ok: %v", state.Get("error"))
+	}
+
+	cdPath := state.Get("cd_path").(string)
+	if cdPath != state.Get("cidata_path").(string) {
+		t.Fatalf("cd_path and cidata_path should match")
+	}
+
+	if _, err := os.Stat(cdPath); err != nil {
+		t.Fatalf("file not found: %s", cdPath)
+	}
+
+	if !step.FilesAdded["user-data"] || !step.FilesAdded["meta-data"] {
+		t.Fatalf("expected user-data and meta-data to be recorded, got %v", step.FilesAdded)
+	}
+
+	step.Cleanup(state)
+
+	if _, err := os.Stat(cdPath); err == nil {
+		t.Fatalf("file found: %s", cdPath)
+	}
+}
+
+func TestStepCreateCIDATA_networkAndVendorData(t *testing.T) {
+	state := testStepCreateCIDATAState(t)
+	step := &StepCreateCIDATA{
+		UserData:            "#cloud-config\n",
+		MetaData:            "instance-id: packer\nlocal-hostname: packer\n",
+		NetworkConfig:       "version: 2\n",
+		VendorData:          "#cloud-config\n",
+		AcknowledgeNoJoliet: true,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatalf("state should be ok: %v", state.Get("error"))
+	}
+
+	for _, dest := range []string{"user-data", "meta-data", "network-config", "vendor-data"} {
+		if !step.FilesAdded[dest] {
+			t.Fatalf("expected %s to be recorded, got %v", dest, step.FilesAdded)
+		}
+	}
+}
+
+func TestStepCreateCIDATA_content(t *testing.T) {
+	state := testStepCreateCIDATAState(t)
+	step := &StepCreateCIDATA{
+		Content: map[string]string{
+			"extra.txt": "hello",
+		},
+		AcknowledgeNoJoliet: true,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if !step.FilesAdded["extra.txt"] {
+		t.Fatalf("expected extra.txt to be recorded, got %v", step.FilesAdded)
+	}
+}
+
+func TestStepCreateCIDATA_files(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileA := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(fileA, []byte("hello"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateCIDATAState(t)
+	step := &StepCreateCIDATA{
+		Files:               []string{fileA},
+		AcknowledgeNoJoliet: true,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if !step.FilesAdded[fileA] {
+		t.Fatalf("expected %s to be recorded, got %v", fileA, step.FilesAdded)
+	}
+}
+
+func TestStepCreateCIDATA_directories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fileA := filepath.Join(src, "a.txt")
+	if err := ioutil.WriteFile(fileA, []byte("hello"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateCIDATAState(t)
+	step := &StepCreateCIDATA{
+		Directories:         []string{src},
+		AcknowledgeNoJoliet: true,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if !step.FilesAdded[fileA] {
+		t.Fatalf("expected %s to be recorded, got %v", fileA, step.FilesAdded)
+	}
+}
+
+func TestStepCreateCIDATA_requiresAcknowledgeNoJoliet(t *testing.T) {
+	state := testStepCreateCIDATAState(t)
+	step := &StepCreateCIDATA{
+		UserData: "#cloud-config\n",
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v, expected missing AcknowledgeNoJoliet to halt", action)
+	}
+
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatalf("state should have an error when AcknowledgeNoJoliet is unset")
+	}
+}
+
+func TestStepCreateCIDATA_empty(t *testing.T) {
+	state := testStepCreateCIDATAState(t)
+	step := new(StepCreateCIDATA)
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if _, ok := state.GetOk("cd_path"); ok {
+		t.Fatalf("cd_path should not be set when there is nothing to write")
+	}
+}
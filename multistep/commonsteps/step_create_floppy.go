@@ -0,0 +1,873 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package commonsteps
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	fs "github.com/mitchellh/go-fs"
+	"github.com/mitchellh/go-fs/fat"
+	"github.com/moby/patternmatcher"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/afero"
+)
+
+// FilterOpt controls which files a recursive Directories walk actually
+// includes, using the same `**` and `!pattern` semantics as Docker's
+// .dockerignore (see github.com/moby/patternmatcher). Patterns are
+// matched against the path a file gets on the floppy, with slashes
+// regardless of OS: for a Directories entry that is the path relative
+// to the entry's parent, so it begins with the entry's own name; for a
+// Files entry it is the file's base name.
+type FilterOpt struct {
+	// IncludePatterns, if non-empty, restricts the walk to paths that
+	// match at least one pattern.
+	IncludePatterns []string
+
+	// ExcludePatterns removes matching paths. A pattern prefixed with
+	// `!` re-includes a path that an earlier pattern excluded.
+	ExcludePatterns []string
+
+	// FollowPaths makes the walk follow symlinked directories and
+	// files it encounters instead of skipping them.
+	//
+	// Deprecated: set StepCreateFloppy.SymlinkPolicy instead, which
+	// supersedes this field. FollowPaths is still honored as an alias
+	// for SymlinkFollow when SymlinkPolicy is left unset.
+	FollowPaths bool
+}
+
+// SymlinkPolicy controls how StepCreateFloppy's Directories walk treats
+// symlinks it encounters.
+type SymlinkPolicy string
+
+const (
+	// SymlinkFollow dereferences symlinked files and directories and
+	// stages whatever they point to, as if the link were a copy.
+	SymlinkFollow SymlinkPolicy = "follow"
+
+	// SymlinkSkip leaves symlinks off the floppy entirely. This is the
+	// default.
+	SymlinkSkip SymlinkPolicy = "skip"
+
+	// SymlinkCopy resolves the link's target once and embeds its
+	// contents under the link's own name, rather than the target's.
+	SymlinkCopy SymlinkPolicy = "copy"
+
+	// SymlinkError halts the step the first time a symlink is found.
+	SymlinkError SymlinkPolicy = "error"
+)
+
+// FloppyLink records a symlink the Directories walk encountered,
+// regardless of SymlinkPolicy, so that steps downstream of
+// StepCreateFloppy can reason about links that were skipped, copied, or
+// followed.
+type FloppyLink struct {
+	// Path is the symlink's own path, relative to the parent of the
+	// Directories entry it was found under (so it begins with that
+	// entry's name).
+	Path string
+
+	// Target is the raw target the symlink points to, as returned by
+	// os.Readlink.
+	Target string
+}
+
+// StepCreateFloppy will create a floppy disk with the given files.
+//
+// Uses:
+//
+//	ui     packersdk.Ui
+//
+// Produces:
+//
+//	floppy_path string - The path to the floppy disk that was created.
+type StepCreateFloppy struct {
+	// Files is a list of files or glob patterns to copy onto the floppy.
+	Files []string
+
+	// Directories is a list of directories or glob patterns whose
+	// contents will be copied onto the floppy, preserving their
+	// relative structure. Filter narrows down what each entry
+	// contributes.
+	Directories []string
+
+	// Content is a map from a path on the floppy to the literal
+	// contents that should be written there.
+	Content map[string]string
+
+	// Label is the label to give the floppy volume. Defaults to
+	// "packer" if empty.
+	Label string
+
+	// Filter restricts and extends what Directories pulls in. See
+	// FilterOpt for its pattern semantics.
+	Filter FilterOpt
+
+	// Fs is the filesystem Files, Directories, and Content are staged
+	// from. Defaults to afero.NewOsFs(). Tests use afero.NewMemMapFs()
+	// so they never touch disk for their input tree.
+	Fs afero.Fs
+
+	// Output is the filesystem the generated floppy image itself is
+	// written to. Defaults to afero.NewOsFs(). The underlying FAT
+	// writer needs a real, seekable file, so Output must resolve to
+	// one -- an in-memory Output is only useful for Cleanup/error-path
+	// tests that never reach createFloppy.
+	Output afero.Fs
+
+	// SymlinkPolicy says what to do with symlinks found under
+	// Directories. Defaults to SymlinkSkip, unless Filter.FollowPaths
+	// is set, in which case it defaults to SymlinkFollow.
+	SymlinkPolicy SymlinkPolicy
+
+	// FilesAdded keeps track, by source path, of every file that was
+	// added to the floppy image; Content entries are keyed by their
+	// path on the floppy instead. It's primarily useful for tests and
+	// for callers that want to know exactly what ended up on disk.
+	FilesAdded map[string]bool
+
+	// FloppyLinks records every symlink the Directories walk found,
+	// independent of SymlinkPolicy.
+	FloppyLinks []FloppyLink
+
+	// CacheDir, if set, short-circuits floppy creation: once the
+	// digest of the resolved inputs is known, a previous image built
+	// from the same digest is reused instead of rebuilding it, and a
+	// newly-built image is saved there for next time.
+	CacheDir string
+
+	floppyPath string
+	cached     bool
+}
+
+func (s *StepCreateFloppy) fs() afero.Fs {
+	if s.Fs == nil {
+		return afero.NewOsFs()
+	}
+	return s.Fs
+}
+
+func (s *StepCreateFloppy) outputFs() afero.Fs {
+	if s.Output == nil {
+		return afero.NewOsFs()
+	}
+	return s.Output
+}
+
+func (s *StepCreateFloppy) symlinkPolicy() SymlinkPolicy {
+	if s.SymlinkPolicy != "" {
+		return s.SymlinkPolicy
+	}
+	if s.Filter.FollowPaths {
+		return SymlinkFollow
+	}
+	return SymlinkSkip
+}
+
+func (s *StepCreateFloppy) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	if len(s.Files) == 0 && len(s.Directories) == 0 && len(s.Content) == 0 {
+		log.Println("No floppy files specified. Floppy disk will not be made.")
+		return multistep.ActionContinue
+	}
+
+	s.FilesAdded = make(map[string]bool)
+
+	ui.Say("Creating floppy disk...")
+
+	// Resolve the set of files that will live on the floppy, keyed by
+	// their destination path on the image.
+	floppyFiles, err := s.resolveFiles()
+	if err != nil {
+		state.Put("error", fmt.Errorf("error resolving floppy files: %s", err))
+		return multistep.ActionHalt
+	}
+
+	floppyFiles, err = s.addDirectories(floppyFiles)
+	if err != nil {
+		state.Put("error", fmt.Errorf("error resolving floppy directories: %s", err))
+		return multistep.ActionHalt
+	}
+
+	if len(s.FloppyLinks) > 0 {
+		state.Put("floppy_links", s.FloppyLinks)
+	}
+
+	dgst, err := s.digest(floppyFiles)
+	if err != nil {
+		state.Put("error", fmt.Errorf("error computing floppy digest: %s", err))
+		return multistep.ActionHalt
+	}
+	state.Put("floppy_digest", dgst.String())
+
+	if s.CacheDir != "" {
+		if cached, ok := s.cachedFloppy(dgst); ok {
+			ui.Message("Using cached floppy disk")
+			s.floppyPath = cached
+			s.cached = true
+			state.Put("floppy_path", s.floppyPath)
+
+			// createFloppy never runs on a cache hit, but FilesAdded
+			// is documented to reflect every file that ended up on
+			// the image, so populate it from the same resolved set
+			// that would have been built.
+			for source := range floppyFiles {
+				s.FilesAdded[source] = true
+			}
+			for key := range s.Content {
+				s.FilesAdded[key] = true
+			}
+
+			return multistep.ActionContinue
+		}
+	}
+
+	path, err := s.createFloppy(floppyFiles)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	s.floppyPath = path
+	state.Put("floppy_path", s.floppyPath)
+
+	if s.CacheDir != "" {
+		if err := s.saveFloppyToCache(path, dgst); err != nil {
+			ui.Error(fmt.Sprintf("Error caching floppy disk: %s", err))
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+// digest computes a stable digest over the resolved floppy inputs --
+// every file keyed by its archive path (so glob/directory expansion is
+// already baked in) plus every inline Content entry -- so StepCreateFloppy
+// can tell whether it needs to rebuild the image at all. It shares its
+// per-file hashing with ChecksumWildcard (via hashEntry) so the two
+// don't drift into different notions of "the inputs changed".
+func (s *StepCreateFloppy) digest(files map[string]string) (digest.Digest, error) {
+	digester := digest.Canonical.Digester()
+	w := digester.Hash()
+
+	// Label is burned into the image by createFloppy, not just its
+	// file contents, so it has to be part of what makes two builds
+	// "the same" for caching purposes.
+	fmt.Fprintf(w, "label %s\n", s.Label)
+
+	bySource := make(map[string]string, len(files))
+	dests := make([]string, 0, len(files))
+	for source, dest := range files {
+		bySource[dest] = source
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+
+	for _, dest := range dests {
+		if err := hashEntry(w, s.fs(), dest, bySource[dest], true); err != nil {
+			return "", err
+		}
+	}
+
+	contentKeys := make([]string, 0, len(s.Content))
+	for key := range s.Content {
+		contentKeys = append(contentKeys, key)
+	}
+	sort.Strings(contentKeys)
+
+	for _, key := range contentKeys {
+		sum := sha256.Sum256([]byte(s.Content[key]))
+		fmt.Fprintf(w, "content %s %x\n", key, sum)
+	}
+
+	return digester.Digest(), nil
+}
+
+// cachedFloppy returns the path of a previously-built image matching
+// dgst under s.CacheDir, if one exists.
+func (s *StepCreateFloppy) cachedFloppy(dgst digest.Digest) (string, bool) {
+	path := filepath.Join(s.CacheDir, dgst.Encoded()+".img")
+	if info, err := s.outputFs().Stat(path); err == nil && !info.IsDir() {
+		return path, true
+	}
+	return "", false
+}
+
+// saveFloppyToCache copies the image at path into s.CacheDir under
+// dgst, so a future run with identical inputs can reuse it.
+func (s *StepCreateFloppy) saveFloppyToCache(path string, dgst digest.Digest) error {
+	if err := s.outputFs().MkdirAll(s.CacheDir, 0755); err != nil {
+		return fmt.Errorf("error creating cache dir '%s': %s", s.CacheDir, err)
+	}
+
+	data, err := afero.ReadFile(s.outputFs(), path)
+	if err != nil {
+		return fmt.Errorf("error reading built floppy '%s': %s", path, err)
+	}
+
+	cachePath := filepath.Join(s.CacheDir, dgst.Encoded()+".img")
+	return afero.WriteFile(s.outputFs(), cachePath, data, 0644)
+}
+
+// resolveFiles expands s.Files (literal paths and glob patterns) into a
+// map from source path to destination path on the floppy, applying
+// s.Filter the same way addDirectories does so Files and Directories
+// are governed by one filter.
+func (s *StepCreateFloppy) resolveFiles() (map[string]string, error) {
+	result := make(map[string]string)
+
+	includeMatcher, excludeMatcher, err := s.Filter.matchers()
+	if err != nil {
+		return nil, err
+	}
+
+	add := func(source, rel string) error {
+		included, err := matchesFilter(rel, includeMatcher, excludeMatcher)
+		if err != nil {
+			return err
+		}
+		if included {
+			result[source] = rel
+		}
+		return nil
+	}
+
+	for _, path := range s.Files {
+		if !hasGlobMeta(path) {
+			info, err := s.fs().Stat(path)
+			if err != nil {
+				return nil, fmt.Errorf("bad file '%s': %s", path, err)
+			}
+
+			if info.IsDir() {
+				entries, err := afero.ReadDir(s.fs(), path)
+				if err != nil {
+					return nil, fmt.Errorf("bad directory '%s': %s", path, err)
+				}
+				for _, entry := range entries {
+					if entry.IsDir() {
+						continue
+					}
+					if err := add(filepath.Join(path, entry.Name()), entry.Name()); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+
+			if err := add(path, filepath.Base(path)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		matches, err := afero.Glob(s.fs(), path)
+		if err != nil {
+			return nil, fmt.Errorf("bad glob pattern '%s': %s", path, err)
+		}
+
+		for _, match := range matches {
+			if err := add(match, filepath.Base(match)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// addDirectories walks s.Directories, copying the relative structure of
+// each entry onto the floppy, applying s.Filter and s.SymlinkPolicy
+// along the way.
+func (s *StepCreateFloppy) addDirectories(result map[string]string) (map[string]string, error) {
+	if result == nil {
+		result = make(map[string]string)
+	}
+
+	includeMatcher, excludeMatcher, err := s.Filter.matchers()
+	if err != nil {
+		return nil, err
+	}
+	policy := s.symlinkPolicy()
+
+	for _, path := range s.Directories {
+		matches := []string{path}
+		if hasGlobMeta(path) {
+			var err error
+			matches, err = afero.Glob(s.fs(), path)
+			if err != nil {
+				return nil, fmt.Errorf("bad glob pattern '%s': %s", path, err)
+			}
+		}
+
+		for _, match := range matches {
+			info, err := s.lstat(match)
+			if err != nil {
+				// Non-existent matches from a glob are simply skipped;
+				// an explicit, literal path that's missing is an error.
+				if !hasGlobMeta(path) {
+					return nil, fmt.Errorf("bad directory '%s': %s", match, err)
+				}
+				continue
+			}
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, err := s.readlink(match)
+				if err != nil {
+					return nil, fmt.Errorf("error reading link '%s': %s", match, err)
+				}
+				l := fsLink{path: match, rel: filepath.Base(match), target: target}
+				s.FloppyLinks = append(s.FloppyLinks, FloppyLink{Path: l.rel, Target: l.target})
+
+				// match is the Directories entry itself, not a link
+				// found while walking one, so there is no staging
+				// root for SymlinkFollow's escape check to apply to.
+				resolved, err := s.resolveLink("", l, policy)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, f := range resolved {
+					included, err := matchesFilter(f.rel, includeMatcher, excludeMatcher)
+					if err != nil {
+						return nil, err
+					}
+					if !included {
+						continue
+					}
+					result[f.path] = f.rel
+				}
+				continue
+			}
+
+			if !info.IsDir() {
+				rel := filepath.Base(match)
+				included, err := matchesFilter(rel, includeMatcher, excludeMatcher)
+				if err != nil {
+					return nil, err
+				}
+				if included {
+					result[match] = rel
+				}
+				continue
+			}
+
+			fstate, err := s.walkDirectoryTree(match)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, f := range fstate.files {
+				included, err := matchesFilter(f.rel, includeMatcher, excludeMatcher)
+				if err != nil {
+					return nil, err
+				}
+				if !included {
+					continue
+				}
+				result[f.path] = f.rel
+			}
+
+			for _, l := range fstate.links {
+				s.FloppyLinks = append(s.FloppyLinks, FloppyLink{Path: l.rel, Target: l.target})
+
+				resolved, err := s.resolveLink(match, l, policy)
+				if err != nil {
+					return nil, err
+				}
+
+				for _, f := range resolved {
+					included, err := matchesFilter(f.rel, includeMatcher, excludeMatcher)
+					if err != nil {
+						return nil, err
+					}
+					if !included {
+						continue
+					}
+					result[f.path] = f.rel
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// fsEntry is a regular file found while staging a Directories entry,
+// named by both its real path on disk and its path relative to the
+// staging root (the destination it will have on the floppy).
+type fsEntry struct {
+	path string
+	rel  string
+}
+
+// fsLink is a symlink found while staging a Directories entry.
+type fsLink struct {
+	path   string
+	rel    string
+	target string
+}
+
+// filesystemState is the result of walking a Directories entry, with
+// dirs, files, and links bucketed separately so SymlinkPolicy can be
+// applied to links without having already decided what to do with them
+// mid-walk.
+type filesystemState struct {
+	dirs  []string
+	files []fsEntry
+	links []fsLink
+}
+
+// walkDirectoryTree walks root against s.fs(), reading each directory
+// with Readdir rather than Stat-ing individual entries so that
+// symlinks are reported as themselves (os.ModeSymlink set) instead of
+// being silently resolved by the walk.
+func (s *StepCreateFloppy) walkDirectoryTree(root string) (*filesystemState, error) {
+	state := &filesystemState{}
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		d, err := s.fs().Open(dir)
+		if err != nil {
+			return err
+		}
+		entries, err := d.Readdir(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			p := filepath.Join(dir, entry.Name())
+
+			rel, relErr := filepath.Rel(filepath.Dir(root), p)
+			if relErr != nil {
+				return relErr
+			}
+			rel = filepath.ToSlash(rel)
+
+			switch {
+			case entry.Mode()&os.ModeSymlink != 0:
+				target, err := s.readlink(p)
+				if err != nil {
+					return fmt.Errorf("error reading link '%s': %s", p, err)
+				}
+				state.links = append(state.links, fsLink{path: p, rel: rel, target: target})
+			case entry.IsDir():
+				state.dirs = append(state.dirs, p)
+				if err := walk(p); err != nil {
+					return err
+				}
+			default:
+				state.files = append(state.files, fsEntry{path: p, rel: rel})
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// lstat stats path without following a trailing symlink, when s.fs()
+// is able to (only real filesystems generally are).
+func (s *StepCreateFloppy) lstat(path string) (os.FileInfo, error) {
+	if lst, ok := s.fs().(afero.Lstater); ok {
+		info, _, err := lst.LstatIfPossible(path)
+		return info, err
+	}
+	return s.fs().Stat(path)
+}
+
+// readlink reads the target of a symlink, when s.fs() supports
+// symlinks at all (afero.MemMapFs, notably, does not).
+func (s *StepCreateFloppy) readlink(path string) (string, error) {
+	if lr, ok := s.fs().(afero.LinkReader); ok {
+		return lr.ReadlinkIfPossible(path)
+	}
+	return "", fmt.Errorf("filesystem does not support symlinks")
+}
+
+// resolveLink applies policy to a single symlink found under root,
+// returning zero or more files that should be staged in its place.
+func (s *StepCreateFloppy) resolveLink(root string, l fsLink, policy SymlinkPolicy) ([]fsEntry, error) {
+	switch policy {
+	case SymlinkSkip, "":
+		return nil, nil
+
+	case SymlinkError:
+		return nil, fmt.Errorf("symlink '%s' -> '%s' found under '%s', but SymlinkPolicy is SymlinkError", l.path, l.target, root)
+
+	case SymlinkCopy:
+		resolved, err := filepath.EvalSymlinks(l.path)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving link '%s': %s", l.path, err)
+		}
+		info, err := s.fs().Stat(resolved)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving link '%s': %s", l.path, err)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("symlink '%s' points at directory '%s'; SymlinkCopy only supports file targets", l.path, resolved)
+		}
+		// The copy is stored under the link's own name, not the
+		// target's -- the whole point is to embed the content where
+		// the link was.
+		return []fsEntry{{path: resolved, rel: l.rel}}, nil
+
+	case SymlinkFollow:
+		target := l.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(l.path), target)
+		}
+		target, err := filepath.EvalSymlinks(target)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving link '%s': %s", l.path, err)
+		}
+
+		// root is empty when l is itself a Directories entry rather
+		// than a link found while walking one -- there is no
+		// containing tree for it to escape, so the check doesn't
+		// apply.
+		if root != "" {
+			if rel, err := filepath.Rel(root, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil, fmt.Errorf("symlink '%s' points outside of staging root '%s' to '%s'", l.path, root, target)
+			}
+		}
+
+		info, err := s.fs().Stat(target)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving link '%s': %s", l.path, err)
+		}
+
+		if !info.IsDir() {
+			return []fsEntry{{path: target, rel: l.rel}}, nil
+		}
+
+		sub, err := s.walkDirectoryTree(target)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nested symlinks found while walking target still need a
+		// root to be checked against. When root is empty (l is the
+		// Directories entry itself), target -- what l resolved to --
+		// becomes that root, the same way a literal directory entry
+		// roots the links found under it; otherwise keep the
+		// original, already-meaningful root.
+		innerRoot := root
+		if innerRoot == "" {
+			innerRoot = target
+		}
+
+		var result []fsEntry
+		result = append(result, sub.files...)
+		for _, inner := range sub.links {
+			tail, err := filepath.Rel(target, inner.path)
+			if err != nil {
+				return nil, err
+			}
+			inner.rel = filepath.ToSlash(filepath.Join(l.rel, tail))
+			s.FloppyLinks = append(s.FloppyLinks, FloppyLink{Path: inner.rel, Target: inner.target})
+
+			innerResolved, err := s.resolveLink(innerRoot, inner, policy)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, innerResolved...)
+		}
+
+		// Re-root each entry's rel path under the link's own name
+		// rather than the target directory's name.
+		for i, f := range result {
+			tail, err := filepath.Rel(target, f.path)
+			if err != nil {
+				return nil, err
+			}
+			result[i].rel = filepath.ToSlash(filepath.Join(l.rel, tail))
+		}
+
+		return result, nil
+
+	default:
+		return nil, fmt.Errorf("unknown SymlinkPolicy %q", policy)
+	}
+}
+
+// matchers builds the include/exclude pattern matchers described by a
+// FilterOpt. Either may be nil when the corresponding pattern list is
+// empty, in which case that half of the filter always passes.
+func (f *FilterOpt) matchers() (include, exclude *patternmatcher.PatternMatcher, err error) {
+	if len(f.IncludePatterns) > 0 {
+		include, err = patternmatcher.New(f.IncludePatterns)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad include pattern: %s", err)
+		}
+	}
+
+	if len(f.ExcludePatterns) > 0 {
+		exclude, err = patternmatcher.New(f.ExcludePatterns)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad exclude pattern: %s", err)
+		}
+	}
+
+	return include, exclude, nil
+}
+
+// matchesFilter reports whether rel should be included, given the
+// matchers built from a FilterOpt: it must match IncludePatterns (if
+// any were given) and must not match ExcludePatterns, modulo `!`
+// re-inclusion, which patternmatcher already accounts for.
+func matchesFilter(rel string, include, exclude *patternmatcher.PatternMatcher) (bool, error) {
+	if include != nil {
+		ok, err := include.MatchesOrParentMatches(rel)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	if exclude != nil {
+		ok, err := exclude.MatchesOrParentMatches(rel)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (s *StepCreateFloppy) createFloppy(files map[string]string) (string, error) {
+	floppyFile, err := afero.TempFile(s.outputFs(), "", "packer")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file for floppy: %s", err)
+	}
+	defer floppyFile.Close()
+
+	if err := floppyFile.Truncate(1474560); err != nil {
+		return "", fmt.Errorf("error creating floppy's file: %s", err)
+	}
+
+	label := s.Label
+	if label == "" {
+		label = "packer"
+	}
+
+	osFile, ok := floppyFile.(*os.File)
+	if !ok {
+		return "", fmt.Errorf("floppy Output must be backed by a real file, got %T", floppyFile)
+	}
+
+	device, err := fs.NewFileDisk(osFile)
+	if err != nil {
+		return "", fmt.Errorf("error setting up floppy disk: %s", err)
+	}
+
+	if err := fat.FormatSuperFloppy(device, &fat.SuperFloppyConfig{Label: label}); err != nil {
+		return "", fmt.Errorf("error formatting floppy: %s", err)
+	}
+
+	floppyFs, err := fat.New(device)
+	if err != nil {
+		return "", fmt.Errorf("error opening formatted floppy: %s", err)
+	}
+
+	rootDir, err := floppyFs.RootDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting floppy root: %s", err)
+	}
+
+	for source, dest := range files {
+		if err := s.copyFileToFloppy(rootDir, source, dest); err != nil {
+			return "", err
+		}
+		s.FilesAdded[source] = true
+	}
+
+	for dest, content := range s.Content {
+		if err := s.copyContentToFloppy(rootDir, dest, content); err != nil {
+			return "", err
+		}
+		s.FilesAdded[dest] = true
+	}
+
+	return floppyFile.Name(), nil
+}
+
+func (s *StepCreateFloppy) copyFileToFloppy(rootDir fs.Directory, source, dest string) error {
+	data, err := afero.ReadFile(s.fs(), source)
+	if err != nil {
+		return fmt.Errorf("error reading file '%s': %s", source, err)
+	}
+
+	entry, err := rootDir.AddFile(filepath.ToSlash(dest))
+	if err != nil {
+		return fmt.Errorf("error adding file '%s' to floppy: %s", dest, err)
+	}
+
+	writer, err := entry.File()
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return fmt.Errorf("error writing '%s' to floppy: %s", dest, err)
+	}
+
+	return nil
+}
+
+func (s *StepCreateFloppy) copyContentToFloppy(rootDir fs.Directory, dest, content string) error {
+	entry, err := rootDir.AddFile(filepath.ToSlash(dest))
+	if err != nil {
+		return fmt.Errorf("error adding file '%s' to floppy: %s", dest, err)
+	}
+
+	writer, err := entry.File()
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write([]byte(content)); err != nil {
+		return fmt.Errorf("error writing '%s' to floppy: %s", dest, err)
+	}
+
+	return nil
+}
+
+func (s *StepCreateFloppy) Cleanup(state multistep.StateBag) {
+	// A cached image lives under CacheDir for future runs to reuse; it
+	// isn't scratch output, so Cleanup leaves it in place.
+	if s.floppyPath != "" && !s.cached {
+		if err := s.outputFs().Remove(s.floppyPath); err != nil {
+			ui := state.Get("ui").(packersdk.Ui)
+			ui.Error(fmt.Sprintf("Error removing floppy: %s", err))
+		}
+	}
+}
+
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
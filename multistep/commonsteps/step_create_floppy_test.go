@@ -13,10 +13,12 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/spf13/afero"
 )
 
 const TestFixtures = "test-fixtures"
@@ -40,13 +42,10 @@ func testStepCreateFloppyState(t *testing.T) multistep.StateBag {
 
 func TestStepCreateFloppy(t *testing.T) {
 	state := testStepCreateFloppyState(t)
-	step := new(StepCreateFloppy)
+	memFs := afero.NewMemMapFs()
+	step := &StepCreateFloppy{Fs: memFs}
 
-	dir, err := ioutil.TempDir("", "packer")
-	if err != nil {
-		t.Fatalf("err: %s", err)
-	}
-	defer os.RemoveAll(dir)
+	dir := "/packer"
 
 	count := 10
 	expected := count
@@ -58,25 +57,24 @@ func TestStepCreateFloppy(t *testing.T) {
 	for i := 0; i < expected; i++ {
 		files[i] = path.Join(dir, prefix+strconv.Itoa(i)+ext)
 
-		_, err := os.Create(files[i])
-		if err != nil {
+		if err := afero.WriteFile(memFs, files[i], []byte{}, 0644); err != nil {
 			t.Fatalf("err: %s", err)
 		}
 	}
 
 	lists := [][]string{
 		files,
-		{dir + string(os.PathSeparator) + prefix + "*" + ext},
-		{dir + string(os.PathSeparator) + prefix + "?" + ext},
-		{dir + string(os.PathSeparator) + prefix + "[0123456789]" + ext},
-		{dir + string(os.PathSeparator) + prefix + "[0-9]" + ext},
-		{dir + string(os.PathSeparator)},
+		{dir + "/" + prefix + "*" + ext},
+		{dir + "/" + prefix + "?" + ext},
+		{dir + "/" + prefix + "[0123456789]" + ext},
+		{dir + "/" + prefix + "[0-9]" + ext},
+		{dir + "/"},
 		{dir},
 	}
 
 	for _, step.Files = range lists {
 		if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
-			t.Fatalf("bad action: %#v for %v", action, step.Files)
+			t.Fatalf("bad action: %#v for %v : %v", action, step.Files, state.Get("error"))
 		}
 
 		if _, ok := state.GetOk("error"); ok {
@@ -85,6 +83,8 @@ func TestStepCreateFloppy(t *testing.T) {
 
 		floppy_path := state.Get("floppy_path").(string)
 
+		// the generated floppy image is always a real file on disk,
+		// even though the source tree lives on step.Fs.
 		if _, err := os.Stat(floppy_path); err != nil {
 			t.Fatalf("file not found: %s for %v", floppy_path, step.Files)
 		}
@@ -101,6 +101,31 @@ func TestStepCreateFloppy(t *testing.T) {
 	}
 }
 
+func TestStepCreateFloppy_resolveFilesLiteralDirectory(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	dir := "/packer"
+
+	names := []string{"a.txt", "b.txt"}
+	for _, name := range names {
+		if err := afero.WriteFile(memFs, path.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	for _, files := range [][]string{{dir}, {dir + "/"}} {
+		step := &StepCreateFloppy{Fs: memFs, Files: files}
+
+		resolved, err := step.resolveFiles()
+		if err != nil {
+			t.Fatalf("err: %s for %v", err, files)
+		}
+
+		if len(resolved) != len(names) {
+			t.Fatalf("expected %d resolved files for %v, got %d: %v", len(names), files, len(resolved), resolved)
+		}
+	}
+}
+
 func TestStepCreateFloppy_missing(t *testing.T) {
 	state := testStepCreateFloppyState(t)
 	step := new(StepCreateFloppy)
@@ -234,14 +259,25 @@ func TestStepCreateFloppyDirectories(t *testing.T) {
 		},
 	}
 
-	// create the hierarchy for each file
+	// create the hierarchy for each file in an in-memory filesystem,
+	// rather than reading test-fixtures off disk
 	for i := 0; i < 2; i++ {
 		dir := filepath.Join(basePath, fmt.Sprintf("test-%d", i))
 
+		memFs := afero.NewMemMapFs()
+		for _, test := range directories[i] {
+			for _, rpath := range test.result {
+				fpath := filepath.Join(dir, filepath.FromSlash(rpath))
+				if err := afero.WriteFile(memFs, fpath, []byte(rpath), 0644); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+		}
+
 		for _, test := range directories[i] {
 			// create a new state and step
 			state := testStepCreateFloppyState(t)
-			step := new(StepCreateFloppy)
+			step := &StepCreateFloppy{Fs: memFs}
 
 			// modify step.Directories with ones from testcase
 			step.Directories = []string{}
@@ -285,7 +321,7 @@ func TestStepCreateFloppyDirectories(t *testing.T) {
 func TestStepCreateFloppyContent(t *testing.T) {
 	// create a new state and step
 	state := testStepCreateFloppyState(t)
-	step := new(StepCreateFloppy)
+	step := &StepCreateFloppy{Fs: afero.NewMemMapFs()}
 
 	step.Content = map[string]string{
 		"subfolder/meta-data": "subfolder/meta-data from content",
@@ -320,3 +356,791 @@ func TestStepCreateFloppyContent(t *testing.T) {
 		t.Fatalf("file found: %s for %v", floppy_path, step.Content)
 	}
 }
+
+func TestStepCreateFloppyDirectories_filter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{
+		filepath.Join("src", "main.go"),
+		filepath.Join("src", "main.tmp"),
+		filepath.Join("src", "vendor", "pkg", "pkg.go"),
+		filepath.Join("src", "node_modules", "dep", "index.js"),
+	}
+
+	for _, p := range paths {
+		full := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories: []string{filepath.Join(dir, "src")},
+		Filter: FilterOpt{
+			ExcludePatterns: []string{"**/*.tmp", "**/node_modules"},
+		},
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+
+	floppy_path := state.Get("floppy_path").(string)
+	defer step.Cleanup(state)
+
+	if _, err := os.Stat(floppy_path); err != nil {
+		t.Fatalf("file not found: %s", floppy_path)
+	}
+
+	want := map[string]bool{
+		filepath.Join(dir, "src", "main.go"):                         true,
+		filepath.Join(dir, "src", "vendor", "pkg", "pkg.go"):         true,
+		filepath.Join(dir, "src", "main.tmp"):                        false,
+		filepath.Join(dir, "src", "node_modules", "dep", "index.js"): false,
+	}
+
+	for p, expect := range want {
+		if step.FilesAdded[p] != expect {
+			t.Fatalf("expected FilesAdded[%s] = %v, got %v", p, expect, step.FilesAdded[p])
+		}
+	}
+}
+
+func TestStepCreateFloppy_filesFilter(t *testing.T) {
+	state := testStepCreateFloppyState(t)
+	memFs := afero.NewMemMapFs()
+
+	dir := "/packer"
+	paths := map[string]bool{
+		path.Join(dir, "main.go"):  true,
+		path.Join(dir, "main.tmp"): false,
+	}
+	for p := range paths {
+		if err := afero.WriteFile(memFs, p, []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	step := &StepCreateFloppy{
+		Fs:    memFs,
+		Files: []string{path.Join(dir, "*")},
+		Filter: FilterOpt{
+			ExcludePatterns: []string{"*.tmp"},
+		},
+	}
+	defer step.Cleanup(state)
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+
+	for p, expect := range paths {
+		if step.FilesAdded[p] != expect {
+			t.Fatalf("expected FilesAdded[%s] = %v, got %v", p, expect, step.FilesAdded[p])
+		}
+	}
+}
+
+func TestStepCreateFloppyDirectories_filterReinclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{
+		filepath.Join("src", "keep.log"),
+		filepath.Join("src", "drop.log"),
+	}
+
+	for _, p := range paths {
+		full := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories: []string{filepath.Join(dir, "src")},
+		Filter: FilterOpt{
+			ExcludePatterns: []string{"**/*.log", "!**/keep.log"},
+		},
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+
+	floppy_path := state.Get("floppy_path").(string)
+	defer step.Cleanup(state)
+
+	if _, err := os.Stat(floppy_path); err != nil {
+		t.Fatalf("file not found: %s", floppy_path)
+	}
+
+	if !step.FilesAdded[filepath.Join(dir, "src", "keep.log")] {
+		t.Fatalf("expected keep.log to be re-included")
+	}
+	if step.FilesAdded[filepath.Join(dir, "src", "drop.log")] {
+		t.Fatalf("expected drop.log to stay excluded")
+	}
+}
+
+func TestStepCreateFloppyDirectories_filterInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{
+		filepath.Join("src", "main.go"),
+		filepath.Join("src", "main.tmp"),
+		filepath.Join("src", "vendor", "pkg", "pkg.go"),
+	}
+
+	for _, p := range paths {
+		full := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories: []string{filepath.Join(dir, "src")},
+		Filter: FilterOpt{
+			IncludePatterns: []string{"**/*.go"},
+		},
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+
+	floppy_path := state.Get("floppy_path").(string)
+	defer step.Cleanup(state)
+
+	if _, err := os.Stat(floppy_path); err != nil {
+		t.Fatalf("file not found: %s", floppy_path)
+	}
+
+	want := map[string]bool{
+		filepath.Join(dir, "src", "main.go"):                 true,
+		filepath.Join(dir, "src", "vendor", "pkg", "pkg.go"): true,
+		filepath.Join(dir, "src", "main.tmp"):                false,
+	}
+
+	for p, expect := range want {
+		if step.FilesAdded[p] != expect {
+			t.Fatalf("expected FilesAdded[%s] = %v, got %v", p, expect, step.FilesAdded[p])
+		}
+	}
+}
+
+func TestStepCreateFloppyDirectories_filterIncludeAndExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{
+		filepath.Join("src", "main.go"),
+		filepath.Join("src", "main_test.go"),
+		filepath.Join("src", "main.tmp"),
+	}
+
+	for _, p := range paths {
+		full := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories: []string{filepath.Join(dir, "src")},
+		Filter: FilterOpt{
+			IncludePatterns: []string{"**/*.go"},
+			ExcludePatterns: []string{"**/*_test.go"},
+		},
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+
+	floppy_path := state.Get("floppy_path").(string)
+	defer step.Cleanup(state)
+
+	if _, err := os.Stat(floppy_path); err != nil {
+		t.Fatalf("file not found: %s", floppy_path)
+	}
+
+	want := map[string]bool{
+		filepath.Join(dir, "src", "main.go"):      true,
+		filepath.Join(dir, "src", "main_test.go"): false,
+		filepath.Join(dir, "src", "main.tmp"):     false,
+	}
+
+	for p, expect := range want {
+		if step.FilesAdded[p] != expect {
+			t.Fatalf("expected FilesAdded[%s] = %v, got %v", p, expect, step.FilesAdded[p])
+		}
+	}
+}
+
+func TestStepCreateFloppyDirectories_followPathsAliasesSymlinkFollow(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "src"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "src", "real.txt"), []byte("real"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "src", "real.txt"), filepath.Join(root, "src", "link.txt")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories: []string{filepath.Join(root, "src")},
+		Filter: FilterOpt{
+			FollowPaths: true,
+		},
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if !step.FilesAdded[filepath.Join(root, "src", "real.txt")] {
+		t.Fatalf("expected FollowPaths to alias SymlinkFollow and resolve the link, got %v", step.FilesAdded)
+	}
+}
+
+func TestStepCreateFloppyDirectories_followPathsIgnoredWhenSymlinkPolicySet(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "src"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "src", "real.txt"), []byte("real"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "src", "real.txt"), filepath.Join(root, "src", "link.txt")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{filepath.Join(root, "src")},
+		SymlinkPolicy: SymlinkSkip,
+		Filter: FilterOpt{
+			FollowPaths: true,
+		},
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if step.FilesAdded[filepath.Join(root, "src", "real.txt")] {
+		t.Fatalf("expected SymlinkPolicy to supersede the deprecated FollowPaths alias, got %v", step.FilesAdded)
+	}
+}
+
+func setupSymlinkFixture(t *testing.T) (root string, outside string) {
+	root, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	outside, err = ioutil.TempDir("", "packer-outside")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "src"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "src", "real.txt"), []byte("real"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// intra-root link
+	if err := os.Symlink(filepath.Join(root, "src", "real.txt"), filepath.Join(root, "src", "inside-link.txt")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// extra-root link
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "src", "outside-link.txt")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return root, outside
+}
+
+func TestStepCreateFloppyDirectories_symlinkSkip(t *testing.T) {
+	root, outside := setupSymlinkFixture(t)
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(outside)
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{filepath.Join(root, "src")},
+		SymlinkPolicy: SymlinkSkip,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if step.FilesAdded[filepath.Join(root, "src", "inside-link.txt")] {
+		t.Fatalf("expected symlinks to be skipped")
+	}
+	if len(step.FloppyLinks) != 2 {
+		t.Fatalf("expected 2 links recorded, got %d: %v", len(step.FloppyLinks), step.FloppyLinks)
+	}
+}
+
+func TestStepCreateFloppyDirectories_symlinkCopy(t *testing.T) {
+	root, outside := setupSymlinkFixture(t)
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(outside)
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{filepath.Join(root, "src")},
+		SymlinkPolicy: SymlinkCopy,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if !step.FilesAdded[filepath.Join(root, "src", "real.txt")] {
+		t.Fatalf("expected link target to be resolved and copied")
+	}
+}
+
+func TestStepCreateFloppyDirectories_symlinkFollowOutsideRoot(t *testing.T) {
+	root, outside := setupSymlinkFixture(t)
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(outside)
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{filepath.Join(root, "src")},
+		SymlinkPolicy: SymlinkFollow,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v, expected link escaping the staging root to halt", action)
+	}
+
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatalf("state should have an error for a link escaping the staging root")
+	}
+}
+
+func TestStepCreateFloppyDirectories_symlinkFollowDotDotPrefixNotOutsideRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	// "..backup" is a legitimate in-root name that happens to start with
+	// the two characters "..": filepath.Rel("src", "src/..backup/real.txt")
+	// returns "..backup/real.txt", which must not be mistaken for a path
+	// that escapes the staging root via a leading ".." segment.
+	if err := os.MkdirAll(filepath.Join(root, "src", "..backup"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "src", "..backup", "real.txt"), []byte("real"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "src", "..backup", "real.txt"), filepath.Join(root, "src", "link.txt")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{filepath.Join(root, "src")},
+		SymlinkPolicy: SymlinkFollow,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v for link under a '..'-prefixed in-root dir: %v", action, state.Get("error"))
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatalf("state should be ok for a link under a '..'-prefixed in-root dir")
+	}
+}
+
+func TestStepCreateFloppyDirectories_entryIsSymlinkToFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	real := filepath.Join(root, "real.txt")
+	if err := ioutil.WriteFile(real, []byte("real"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	link := filepath.Join(root, "link.txt")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{link},
+		SymlinkPolicy: SymlinkCopy,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if !step.FilesAdded[real] {
+		t.Fatalf("expected link target to be resolved and copied, got %v", step.FilesAdded)
+	}
+	if len(step.FloppyLinks) != 1 {
+		t.Fatalf("expected the Directories entry itself to be recorded as a link, got %v", step.FloppyLinks)
+	}
+}
+
+func TestStepCreateFloppyDirectories_entryIsSymlinkError(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	real := filepath.Join(root, "real.txt")
+	if err := ioutil.WriteFile(real, []byte("real"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	link := filepath.Join(root, "link.txt")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{link},
+		SymlinkPolicy: SymlinkError,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v, expected SymlinkError to halt when the Directories entry itself is a link", action)
+	}
+}
+
+func TestStepCreateFloppyDirectories_entryIsSymlinkToDirFollow(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	// realDir deliberately does NOT live under link's own parent
+	// directory: this is the cloud-init-seed-dir-with-relative-symlinks
+	// case the Directories entry itself being a symlink is meant to
+	// support, and there is no containing tree for it to "escape".
+	realDir := filepath.Join(root, "unrelated", "real")
+	if err := os.MkdirAll(realDir, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(realDir, "real.txt"), []byte("real"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	linkDir := filepath.Join(root, "linked")
+	if err := os.MkdirAll(linkDir, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	link := filepath.Join(linkDir, "link")
+	if err := os.Symlink(realDir, link); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{link},
+		SymlinkPolicy: SymlinkFollow,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer step.Cleanup(state)
+
+	if !step.FilesAdded[filepath.Join(realDir, "real.txt")] {
+		t.Fatalf("expected the symlinked directory's contents to be followed and copied, got %v", step.FilesAdded)
+	}
+}
+
+func TestStepCreateFloppyDirectories_entryIsSymlinkToDirFollowNestedEscapeRejected(t *testing.T) {
+	root, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	outside, err := ioutil.TempDir("", "packer-outside")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// realDir is the symlinked-to directory, allowed to live anywhere
+	// (that's the point of entry-is-a-symlink support); once it's
+	// being walked, though, it becomes the root a nested symlink must
+	// not escape.
+	realDir := filepath.Join(root, "unrelated", "real")
+	if err := os.MkdirAll(realDir, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(realDir, "real.txt"), []byte("real"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(realDir, "escape.txt")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	linkDir := filepath.Join(root, "linked")
+	if err := os.MkdirAll(linkDir, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	link := filepath.Join(linkDir, "link")
+	if err := os.Symlink(realDir, link); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{link},
+		SymlinkPolicy: SymlinkFollow,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v, expected a nested symlink escaping the followed directory to halt", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatalf("state should have an error for a nested link escaping the followed directory")
+	}
+}
+
+func TestStepCreateFloppyDirectories_symlinkError(t *testing.T) {
+	root, outside := setupSymlinkFixture(t)
+	defer os.RemoveAll(root)
+	defer os.RemoveAll(outside)
+
+	state := testStepCreateFloppyState(t)
+	step := &StepCreateFloppy{
+		Directories:   []string{filepath.Join(root, "src")},
+		SymlinkPolicy: SymlinkError,
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v, expected SymlinkError to halt on any link", action)
+	}
+}
+
+func TestStepCreateFloppy_cacheDir(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "packer-cache")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	memFs := afero.NewMemMapFs()
+	if err := afero.WriteFile(memFs, "/input/user-data", []byte("#cloud-config\n"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	newStep := func() *StepCreateFloppy {
+		return &StepCreateFloppy{
+			Fs:       memFs,
+			Files:    []string{"/input/user-data"},
+			CacheDir: cacheDir,
+		}
+	}
+
+	state := testStepCreateFloppyState(t)
+	first := newStep()
+	if action := first.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	firstDigest := state.Get("floppy_digest").(string)
+	// first.Cleanup removes the freshly-built temp image, not the copy
+	// saveFloppyToCache already wrote into cacheDir.
+	first.Cleanup(state)
+
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one cached image, found %d", len(entries))
+	}
+
+	state = testStepCreateFloppyState(t)
+	second := newStep()
+	if action := second.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	secondDigest := state.Get("floppy_digest").(string)
+	secondPath := state.Get("floppy_path").(string)
+
+	if firstDigest != secondDigest {
+		t.Fatalf("expected identical inputs to produce the same digest: %s != %s", firstDigest, secondDigest)
+	}
+
+	wantPath := filepath.Join(cacheDir, strings.TrimPrefix(secondDigest, "sha256:")+".img")
+	if secondPath != wantPath {
+		t.Fatalf("expected the second run to reuse the cached image %s, got %s", wantPath, secondPath)
+	}
+
+	// Reusing a cached image must not delete it out from under future runs.
+	second.Cleanup(state)
+	if _, err := os.Stat(secondPath); err != nil {
+		t.Fatalf("cached image should survive Cleanup: %s", err)
+	}
+
+	os.RemoveAll(cacheDir)
+}
+
+func TestStepCreateFloppy_cacheDirLabelChangeBustsCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "packer-cache")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	memFs := afero.NewMemMapFs()
+	if err := afero.WriteFile(memFs, "/input/user-data", []byte("#cloud-config\n"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state := testStepCreateFloppyState(t)
+	first := &StepCreateFloppy{
+		Fs:       memFs,
+		Files:    []string{"/input/user-data"},
+		CacheDir: cacheDir,
+		Label:    "FIRST",
+	}
+	if action := first.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	firstDigest := state.Get("floppy_digest").(string)
+	first.Cleanup(state)
+
+	state = testStepCreateFloppyState(t)
+	second := &StepCreateFloppy{
+		Fs:       memFs,
+		Files:    []string{"/input/user-data"},
+		CacheDir: cacheDir,
+		Label:    "SECOND",
+	}
+	if action := second.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	secondDigest := state.Get("floppy_digest").(string)
+	defer second.Cleanup(state)
+
+	if firstDigest == secondDigest {
+		t.Fatalf("expected a Label change to change the digest, got the same digest %s for both", firstDigest)
+	}
+	if second.cached {
+		t.Fatalf("expected the Label change to bust the cache and rebuild, not reuse the first run's image")
+	}
+}
+
+func TestStepCreateFloppy_cacheHitPopulatesFilesAdded(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "packer-cache")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	memFs := afero.NewMemMapFs()
+	if err := afero.WriteFile(memFs, "/input/user-data", []byte("#cloud-config\n"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	newStep := func() *StepCreateFloppy {
+		return &StepCreateFloppy{
+			Fs:       memFs,
+			Files:    []string{"/input/user-data"},
+			Content:  map[string]string{"meta-data": "instance-id: test\n"},
+			CacheDir: cacheDir,
+		}
+	}
+
+	state := testStepCreateFloppyState(t)
+	first := newStep()
+	if action := first.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	first.Cleanup(state)
+
+	state = testStepCreateFloppyState(t)
+	second := newStep()
+	if action := second.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v : %v", action, state.Get("error"))
+	}
+	defer second.Cleanup(state)
+
+	if !second.cached {
+		t.Fatalf("expected the second run to be a cache hit")
+	}
+	if !second.FilesAdded["/input/user-data"] {
+		t.Fatalf("expected FilesAdded to reflect staged files on a cache hit, got %v", second.FilesAdded)
+	}
+	if !second.FilesAdded["meta-data"] {
+		t.Fatalf("expected FilesAdded to reflect inline Content on a cache hit, got %v", second.FilesAdded)
+	}
+}